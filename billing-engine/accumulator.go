@@ -1,72 +1,395 @@
 package main
 
 import (
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const unmeteredWindowLabel = "unmetered"
+
+// registerT1/registerT2 are fallback bucket labels for readings that carry
+// cumulative T1/T2 counters but whose tariff has no configured rate windows
+// to resolve them against (registerWindowLabel then has nothing to map to
+// and uses these instead, mirroring unmeteredWindowLabel's flat-rate case for
+// legacy readings).
+const (
+	registerT1 = "T1"
+	registerT2 = "T2"
+)
+
+const recentSampleCapacity = 32
+
+// TodayTotal is the result of GetTodayTotal: the day's total energy plus a
+// breakdown by tariff rate window label (e.g. "T1 peak", "T2 off-peak").
+// Legacy (counter-less) readings that don't fall in any configured window are
+// bucketed under unmeteredWindowLabel, which is what a flat-rate tariff (no
+// windows) produces for them; counter readings use registerT1/registerT2.
+type TodayTotal struct {
+	TotalKWh float64
+	ByWindow map[string]float64
+}
+
+// categoryState is one device category's accumulation state. windowMilliWh
+// entries are bumped via incrementInt64 without a lock. countersMu (the four
+// cumulative registers) and ringMu (the recent-sample ring used for
+// diagnostics) are per-category mutexes: AddReading takes ringMu on every
+// reading and countersMu on every counter reading, so contention on them is
+// spread across categories rather than funneling through one global mutex.
+type categoryState struct {
+	windowMilliWh sync.Map // window label -> *int64, milli-Wh, incremented via incrementInt64
+
+	countersMu   sync.Mutex // guards the four fields below
+	importedT1Wh *int64
+	importedT2Wh *int64
+	exportedT1Wh *int64
+	exportedT2Wh *int64
+
+	lastReadingUnix int64 // atomic, unix seconds of the most recent sample
+
+	ringMu  sync.Mutex
+	ring    [recentSampleCapacity]PowerReading
+	ringLen int
+	ringPos int
+}
+
+func (c *categoryState) recordSample(reading PowerReading) {
+	c.ringMu.Lock()
+	defer c.ringMu.Unlock()
+	c.ring[c.ringPos] = reading
+	c.ringPos = (c.ringPos + 1) % recentSampleCapacity
+	if c.ringLen < recentSampleCapacity {
+		c.ringLen++
+	}
+}
+
+// recentSamples returns up to recentSampleCapacity of the category's most
+// recently seen readings, oldest first.
+func (c *categoryState) recentSamples() []PowerReading {
+	c.ringMu.Lock()
+	defer c.ringMu.Unlock()
+
+	samples := make([]PowerReading, c.ringLen)
+	for i := 0; i < c.ringLen; i++ {
+		samples[i] = c.ring[(c.ringPos-c.ringLen+i+recentSampleCapacity)%recentSampleCapacity]
+	}
+	return samples
+}
+
+func (c *categoryState) addWindowMilliWh(label string, deltaMilliWh int64) {
+	if deltaMilliWh == 0 {
+		return
+	}
+	addr, _ := c.windowMilliWh.LoadOrStore(label, new(int64))
+	incrementInt64(addr.(*int64), deltaMilliWh)
+}
+
+// resetWindows zeros every window counter with an atomic swap and adds the
+// swapped-out values to previous, so energy added concurrently is counted in
+// exactly one of the two days.
+func (c *categoryState) resetWindows(previous *TodayTotal) {
+	c.windowMilliWh.Range(func(label, addr interface{}) bool {
+		kwh := float64(atomic.SwapInt64(addr.(*int64), 0)) / 1_000_000.0
+		previous.ByWindow[label.(string)] += kwh
+		previous.TotalKWh += kwh
+		return true
+	})
+}
+
+// incrementInt64 adds delta to *addr via an explicit compare-and-swap retry
+// loop, so counters can be updated without a lock.
+func incrementInt64(addr *int64, delta int64) int64 {
+	for {
+		old := atomic.LoadInt64(addr)
+		next := old + delta
+		if atomic.CompareAndSwapInt64(addr, old, next) {
+			return next
+		}
+	}
+}
+
+type pendingWrite struct {
+	homeID  string
+	reading PowerReading
+}
+
+const writeBufferSize = 1000
+
 type EnergyAccumulator struct {
-	homeID   string
-	db       *Database
-	mu       sync.RWMutex
-	readings map[string][]PowerReading // device_category -> readings
+	homeID string
+	db     ReadingStore
+
+	categories sync.Map // device_category -> *categoryState
+
+	windowsMu sync.RWMutex
+	windows   []RateWindow // current tariff's rate windows, refreshed by the billing loop
+
+	dayMu sync.RWMutex
+	day   time.Time // start-of-day of the period currently being accumulated
+
+	writes chan pendingWrite
 }
 
-func NewEnergyAccumulator(homeID string, db *Database) *EnergyAccumulator {
-	return &EnergyAccumulator{
-		homeID:   homeID,
-		db:       db,
-		readings: make(map[string][]PowerReading),
+func NewEnergyAccumulator(homeID string, db ReadingStore) *EnergyAccumulator {
+	a := &EnergyAccumulator{
+		homeID: homeID,
+		db:     db,
+		day:    startOfLocalDay(time.Now()),
+		writes: make(chan pendingWrite, writeBufferSize),
 	}
+	go a.flushWrites()
+	go a.runMidnightRollover()
+	return a
 }
 
-func (a *EnergyAccumulator) AddReading(reading PowerReading) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// SetTariffWindows updates the rate windows used to bucket incoming readings.
+// Called by the billing loop whenever the active tariff is (re)loaded, so a
+// tariff change takes effect on the next reading rather than requiring a
+// restart.
+func (a *EnergyAccumulator) SetTariffWindows(windows []RateWindow) {
+	a.windowsMu.Lock()
+	defer a.windowsMu.Unlock()
+	a.windows = windows
+}
+
+func (a *EnergyAccumulator) windowLabelFor(t time.Time) string {
+	a.windowsMu.RLock()
+	defer a.windowsMu.RUnlock()
+
+	for _, w := range a.windows {
+		if w.Contains(t) {
+			return w.Label
+		}
+	}
+	return unmeteredWindowLabel
+}
 
-	// Store reading
-	a.readings[reading.DeviceCategory] = append(
-		a.readings[reading.DeviceCategory],
-		reading,
-	)
+// registerWindowLabel maps a meter register's off-peak/peak semantics to the
+// matching configured RateWindow's Label, so a reading's T1/T2 counters land
+// in the same bucket calculateAndPublishBilling looks the rate up by -
+// regardless of what the operator named the window (the backlog's own
+// example tariff uses "T1 peak"/"T2 off-peak", not literal "T1"/"T2"). Falls
+// back to the register's generic name when no window matches (e.g. a
+// flat-rate tariff with no windows configured), same as the unmetered bucket
+// for legacy readings.
+func (a *EnergyAccumulator) registerWindowLabel(offPeak bool, fallback string) string {
+	a.windowsMu.RLock()
+	defer a.windowsMu.RUnlock()
 
-	// Save to database (async in production)
-	go a.db.SaveReading(a.homeID, reading)
+	for _, w := range a.windows {
+		if w.OffPeak == offPeak {
+			return w.Label
+		}
+	}
+	return fallback
+}
 
-	// Clean old readings (keep last 24 hours)
-	a.cleanOldReadings()
+func (a *EnergyAccumulator) categoryFor(name string) *categoryState {
+	state, _ := a.categories.LoadOrStore(name, &categoryState{})
+	return state.(*categoryState)
 }
 
-func (a *EnergyAccumulator) GetTodayTotal() float64 {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
+// RecentSamples returns the most recently seen readings for a device
+// category, oldest first, for diagnostics - e.g. a future debug endpoint that
+// wants to show what a device has been reporting without querying the store.
+func (a *EnergyAccumulator) RecentSamples(category string) []PowerReading {
+	return a.categoryFor(category).recentSamples()
+}
 
-	startOfDay := time.Now().Truncate(24 * time.Hour)
-	totalKWh := 0.0
+// AddReading buckets reading's interval energy into today's per-window
+// totals and hands the reading off for persistence. It never blocks on the
+// database; apart from a shared read lock on the rate windows, the only locks
+// it takes are that device category's own mutexes.
+//
+// Before enqueueing, it overwrites reading.EnergyWh with the interval energy
+// bucketReading computed, so raw_readings.energy_wh always means "this
+// reading's net energy since the last sample" regardless of whether the
+// device reported it directly or via cumulative T1/T2 counters - continuous
+// aggregates and history queries can then sum that one column uniformly.
+func (a *EnergyAccumulator) AddReading(reading PowerReading) {
+	state := a.categoryFor(reading.DeviceCategory)
+	state.recordSample(reading)
+	reading.EnergyWh = a.bucketReading(state, reading)
+	atomic.StoreInt64(&state.lastReadingUnix, reading.Timestamp.Unix())
 
-	for _, readings := range a.readings {
-		for _, reading := range readings {
-			if reading.Timestamp.After(startOfDay) {
-				// Simplified: assume readings are every 5 seconds, convert W to kWh
-				// In production, use actual energy_wh field
-				totalKWh += reading.PowerW * (5.0 / 3600.0) / 1000.0
+	select {
+	case a.writes <- pendingWrite{homeID: a.homeID, reading: reading}:
+	default:
+		log.Printf("write buffer full, dropping persistence for device_category=%s", reading.DeviceCategory)
+	}
+}
+
+// bucketReading adds reading's interval energy to state's per-window totals
+// and returns that same interval energy in Wh, for AddReading to persist.
+// Readings carrying cumulative T1/T2 counters are diffed against the
+// last-seen value per register (the P1-meter model); readings without any
+// counter fall back to the legacy PowerW/EnergyWh payload, bucketed by
+// looking up which configured rate window contains the reading's timestamp.
+func (a *EnergyAccumulator) bucketReading(state *categoryState, reading PowerReading) float64 {
+	hasCounters := reading.EnergyImportedT1Wh != nil || reading.EnergyImportedT2Wh != nil ||
+		reading.EnergyExportedT1Wh != nil || reading.EnergyExportedT2Wh != nil
+
+	if hasCounters {
+		state.countersMu.Lock()
+		t1DeltaWh := firstSampleDeltaWh(state.importedT1Wh, reading.EnergyImportedT1Wh, "energy_imported_t1_wh") -
+			firstSampleDeltaWh(state.exportedT1Wh, reading.EnergyExportedT1Wh, "energy_exported_t1_wh")
+		t2DeltaWh := firstSampleDeltaWh(state.importedT2Wh, reading.EnergyImportedT2Wh, "energy_imported_t2_wh") -
+			firstSampleDeltaWh(state.exportedT2Wh, reading.EnergyExportedT2Wh, "energy_exported_t2_wh")
+
+		if reading.EnergyImportedT1Wh != nil {
+			state.importedT1Wh = reading.EnergyImportedT1Wh
+		}
+		if reading.EnergyImportedT2Wh != nil {
+			state.importedT2Wh = reading.EnergyImportedT2Wh
+		}
+		if reading.EnergyExportedT1Wh != nil {
+			state.exportedT1Wh = reading.EnergyExportedT1Wh
+		}
+		if reading.EnergyExportedT2Wh != nil {
+			state.exportedT2Wh = reading.EnergyExportedT2Wh
+		}
+		state.countersMu.Unlock()
+
+		state.addWindowMilliWh(a.registerWindowLabel(true, registerT1), int64(t1DeltaWh*1000))
+		state.addWindowMilliWh(a.registerWindowLabel(false, registerT2), int64(t2DeltaWh*1000))
+		return t1DeltaWh + t2DeltaWh
+	}
+
+	// Legacy compatibility shim: no counters, derive energy from EnergyWh when
+	// the producer sends it, else estimate from instantaneous power over the
+	// actual elapsed time since the last sample (a 5-second interval is
+	// assumed instead when there is no previous sample or the gap exceeds 60
+	// seconds, so a stale lastReadingUnix can't blow up the estimate).
+	label := a.windowLabelFor(reading.Timestamp)
+	energyWh := reading.EnergyWh
+	if energyWh == 0 && reading.PowerW != 0 {
+		intervalSeconds := 5.0
+		if last := atomic.LoadInt64(&state.lastReadingUnix); last != 0 {
+			if elapsed := float64(reading.Timestamp.Unix() - last); elapsed > 0 && elapsed <= 60 {
+				intervalSeconds = elapsed
 			}
 		}
+		energyWh = reading.PowerW * (intervalSeconds / 3600.0)
 	}
+	state.addWindowMilliWh(label, int64(energyWh*1000))
+	return energyWh
+}
 
-	return totalKWh
+// counterDeltaWh returns current-previous, or current itself if there is no
+// previous value (the register's first sample) or the counter went backwards
+// (a meter rollover or power-loss reset), since in both cases the prior
+// baseline can't be trusted and the new value is the only energy we can
+// account for. Most callers go through firstSampleDeltaWh instead, which
+// treats "no previous value" specially to avoid a restart-spike; this
+// function is the plain arithmetic both of them build on.
+func counterDeltaWh(previous *int64, current *int64) float64 {
+	if current == nil {
+		return 0
+	}
+	if previous == nil {
+		return float64(*current)
+	}
+	delta := *current - *previous
+	if delta < 0 {
+		delta = *current
+	}
+	return float64(delta)
 }
 
-func (a *EnergyAccumulator) cleanOldReadings() {
-	cutoff := time.Now().Add(-24 * time.Hour)
+// firstSampleDeltaWh is counterDeltaWh with one difference: when previous is
+// nil it returns 0 instead of current's full cumulative value. categoryState's
+// counters live only in memory, with no DB-backed recovery, so previous==nil
+// here means either a register's genuine first-ever sample or (far more
+// likely in practice) this process just (re)started and hasn't seen this
+// register yet - there is no way to tell the two apart. Billing the raw
+// lifetime counter value in that case would produce a one-time spike sized to
+// whatever the meter's cumulative total happens to be, so this treats it as
+// "establish the baseline, bill nothing yet" instead: the energy consumed
+// before this sample goes unbilled exactly once per restart, which is a far
+// smaller and safer error than the alternative.
+func firstSampleDeltaWh(previous, current *int64, register string) float64 {
+	if current == nil {
+		return 0
+	}
+	if previous == nil {
+		log.Printf("no prior value for register %s yet this run, establishing baseline without billing its cumulative total", register)
+		return 0
+	}
+	return counterDeltaWh(previous, current)
+}
 
-	for category, readings := range a.readings {
-		filtered := []PowerReading{}
-		for _, reading := range readings {
-			if reading.Timestamp.After(cutoff) {
-				filtered = append(filtered, reading)
-			}
+// GetTodayTotal sums every category's atomic per-window counters - an
+// O(#categories * #windows) operation regardless of how many samples have
+// arrived today.
+func (a *EnergyAccumulator) GetTodayTotal() TodayTotal {
+	total := TodayTotal{ByWindow: make(map[string]float64)}
+
+	a.categories.Range(func(_, v interface{}) bool {
+		state := v.(*categoryState)
+		state.windowMilliWh.Range(func(label, addr interface{}) bool {
+			kwh := float64(atomic.LoadInt64(addr.(*int64))) / 1_000_000.0
+			total.ByWindow[label.(string)] += kwh
+			total.TotalKWh += kwh
+			return true
+		})
+		return true
+	})
+
+	return total
+}
+
+// flushWrites is the single goroutine that persists readings, replacing the
+// old one-goroutine-per-message approach. It reads off the buffered write
+// channel and writes through to the store; AddReading never waits on it.
+func (a *EnergyAccumulator) flushWrites() {
+	for pending := range a.writes {
+		if err := a.db.SaveReading(pending.homeID, pending.reading); err != nil {
+			log.Printf("Failed to save reading for device_category=%s: %v", pending.reading.DeviceCategory, err)
 		}
-		a.readings[category] = filtered
 	}
 }
+
+// runMidnightRollover wakes once per local midnight, atomically snapshots and
+// zeros every category's counters, and starts a fresh accumulation day. The
+// snapshot it logs is the last word on "yesterday" in memory; the billing
+// loop's periodic SaveBillingSnapshot calls are what actually persist each
+// day's totals; this goroutine only owns resetting the hot-path counters.
+func (a *EnergyAccumulator) runMidnightRollover() {
+	for {
+		time.Sleep(time.Until(nextLocalMidnight(time.Now())))
+		a.rolloverDay()
+	}
+}
+
+// nextLocalMidnight returns the start of the day after now, in now's own
+// location. now.Truncate(24 * time.Hour) is NOT this: Truncate rounds the
+// absolute duration since Go's zero instant, which only lines up with local
+// midnight in UTC, so it drifts by the zone offset everywhere else and jumps
+// by an hour across a DST transition - exactly the boundary RateWindow.Contains
+// buckets readings against using Weekday()/Hour()/Minute() in the local zone.
+func nextLocalMidnight(now time.Time) time.Time {
+	return startOfLocalDay(now).AddDate(0, 0, 1)
+}
+
+// startOfLocalDay returns local midnight on t's own calendar day, in t's own
+// location - see nextLocalMidnight for why this isn't t.Truncate(24 * time.Hour).
+func startOfLocalDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+func (a *EnergyAccumulator) rolloverDay() {
+	previous := TodayTotal{ByWindow: make(map[string]float64)}
+
+	a.categories.Range(func(_, v interface{}) bool {
+		v.(*categoryState).resetWindows(&previous)
+		return true
+	})
+
+	a.dayMu.Lock()
+	a.day = startOfLocalDay(time.Now())
+	a.dayMu.Unlock()
+
+	log.Printf("Midnight rollover: previous day total=%.3fkWh by_window=%v", previous.TotalKWh, previous.ByWindow)
+}
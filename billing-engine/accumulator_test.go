@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// nopReadingStore discards every SaveReading call, for tests that only care
+// about the accumulator's in-memory bucketing.
+type nopReadingStore struct{}
+
+func (nopReadingStore) SaveReading(homeID string, reading PowerReading) error { return nil }
+func (nopReadingStore) QueryReadings(homeID string, from, to time.Time) ([]PowerReading, error) {
+	return nil, nil
+}
+
+func TestAccumulatorBucketsReadingsAcrossPeakOffPeakBoundary(t *testing.T) {
+	loc := mustLoadLocation(t, "UTC")
+	allDays := weekdayMask(time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday)
+
+	a := NewEnergyAccumulator("home_test", nopReadingStore{})
+	a.SetTariffWindows([]RateWindow{
+		{Label: "T1 peak", OffPeak: false, DayMask: allDays, StartMin: 7 * 60, EndMin: 23 * 60, RatePerKWh: 0.40},
+		{Label: "T2 off-peak", OffPeak: true, DayMask: allDays, StartMin: 23 * 60, EndMin: 7 * 60, RatePerKWh: 0.20},
+	})
+
+	// Straddle the peak/off-peak boundary at 23:00: one reading just before,
+	// one just after.
+	a.AddReading(PowerReading{Timestamp: time.Date(2026, 3, 10, 22, 59, 0, 0, loc), DeviceCategory: "main", PowerW: 720, EnergyWh: 12})
+	a.AddReading(PowerReading{Timestamp: time.Date(2026, 3, 10, 23, 1, 0, 0, loc), DeviceCategory: "main", PowerW: 720, EnergyWh: 12})
+
+	total := a.GetTodayTotal()
+	if total.ByWindow["T1 peak"] == 0 {
+		t.Errorf("expected some energy bucketed under T1 peak, got %v", total.ByWindow)
+	}
+	if total.ByWindow["T2 off-peak"] == 0 {
+		t.Errorf("expected some energy bucketed under T2 off-peak, got %v", total.ByWindow)
+	}
+}
+
+func TestAccumulatorBucketsCumulativeCountersByOffPeakFlag(t *testing.T) {
+	loc := mustLoadLocation(t, "UTC")
+	allDays := weekdayMask(time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday)
+
+	a := NewEnergyAccumulator("home_test", nopReadingStore{})
+	// Window labels intentionally don't match the literal "T1"/"T2" register
+	// names, to exercise registerWindowLabel's off-peak/peak matching rather
+	// than an exact-string match against the register name.
+	a.SetTariffWindows([]RateWindow{
+		{Label: "T1 peak", OffPeak: false, DayMask: allDays, StartMin: 0, EndMin: 24 * 60, RatePerKWh: 0.40},
+		{Label: "T2 off-peak", OffPeak: true, DayMask: allDays, StartMin: 0, EndMin: 24 * 60, RatePerKWh: 0.20},
+	})
+
+	ts := time.Date(2026, 3, 10, 12, 0, 0, 0, loc)
+
+	// Each reading gets its own counter variables (not a reassigned shared
+	// one) so EnergyImportedT1Wh/T2Wh point at independent values, the same
+	// way two distinct MQTT messages would never share a pointer.
+	imported1First, imported2First := int64(1000), int64(500)
+	a.AddReading(PowerReading{Timestamp: ts, DeviceCategory: "main", EnergyImportedT1Wh: &imported1First, EnergyImportedT2Wh: &imported2First})
+
+	// This first sample only establishes the baseline (see
+	// firstSampleDeltaWh) and should not yet appear in today's total.
+	if total := a.GetTodayTotal(); total.TotalKWh != 0 {
+		t.Errorf("TotalKWh after the baseline-establishing sample = %v, want 0", total.TotalKWh)
+	}
+
+	imported1Second, imported2Second := int64(1200), int64(600)
+	a.AddReading(PowerReading{Timestamp: ts.Add(time.Minute), DeviceCategory: "main", EnergyImportedT1Wh: &imported1Second, EnergyImportedT2Wh: &imported2Second})
+
+	total := a.GetTodayTotal()
+	if got, want := total.ByWindow["T2 off-peak"], 0.2; got < want-0.001 || got > want+0.001 {
+		t.Errorf("T2 off-peak kWh = %v, want %v (200Wh delta on the off-peak register)", got, want)
+	}
+	if got, want := total.ByWindow["T1 peak"], 0.1; got < want-0.001 || got > want+0.001 {
+		t.Errorf("T1 peak kWh = %v, want %v (100Wh delta on the peak register)", got, want)
+	}
+}
+
+func TestCounterDeltaWh(t *testing.T) {
+	c := func(v int64) *int64 { return &v }
+
+	if got, want := counterDeltaWh(nil, c(1000)), 1000.0; got != want {
+		t.Errorf("counterDeltaWh(nil, 1000) = %v, want %v (no baseline, return current)", got, want)
+	}
+	if got, want := counterDeltaWh(c(1000), c(1200)), 200.0; got != want {
+		t.Errorf("counterDeltaWh(1000, 1200) = %v, want %v", got, want)
+	}
+	if got, want := counterDeltaWh(c(1200), c(100)), 100.0; got != want {
+		t.Errorf("counterDeltaWh(1200, 100) = %v, want %v (rollover/reset, return current)", got, want)
+	}
+	if got, want := counterDeltaWh(c(1000), nil), 0.0; got != want {
+		t.Errorf("counterDeltaWh(1000, nil) = %v, want %v (register not reported this sample)", got, want)
+	}
+}
+
+func TestFirstSampleDeltaWhSkipsUnbaselinedRegister(t *testing.T) {
+	c := func(v int64) *int64 { return &v }
+
+	if got, want := firstSampleDeltaWh(nil, c(1_000_000), "energy_imported_t1_wh"), 0.0; got != want {
+		t.Errorf("firstSampleDeltaWh(nil, ...) = %v, want %v (restart-spike guard: no baseline yet)", got, want)
+	}
+	if got, want := firstSampleDeltaWh(c(1000), c(1200), "energy_imported_t1_wh"), 200.0; got != want {
+		t.Errorf("firstSampleDeltaWh(1000, 1200, ...) = %v, want %v (baseline exists, normal delta)", got, want)
+	}
+}
+
+func TestNextLocalMidnightCrossesDSTTransition(t *testing.T) {
+	loc := mustLoadLocation(t, "America/New_York")
+
+	beforeSpringForward := time.Date(2026, 3, 7, 15, 0, 0, 0, loc)
+	next := nextLocalMidnight(beforeSpringForward)
+	want := time.Date(2026, 3, 8, 0, 0, 0, 0, loc)
+	if !next.Equal(want) {
+		t.Errorf("nextLocalMidnight(%v) = %v, want %v", beforeSpringForward, next, want)
+	}
+
+	beforeFallBack := time.Date(2026, 10, 31, 15, 0, 0, 0, loc)
+	next = nextLocalMidnight(beforeFallBack)
+	want = time.Date(2026, 11, 1, 0, 0, 0, 0, loc)
+	if !next.Equal(want) {
+		t.Errorf("nextLocalMidnight(%v) = %v, want %v", beforeFallBack, next, want)
+	}
+}
@@ -2,12 +2,29 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
 )
 
+// Database wraps the Postgres connection. The `tariffs` table is expected to
+// carry a `base_rate` column (flat-rate fallback) alongside the existing
+// `co2_factor_kg_per_kwh`, and two new tables describe time-of-use tariffs:
+//
+//	tariff_rate_windows(tariff_id, label, off_peak, day_mask, start_min, end_min, rate_per_kwh)
+//	tariff_tiers(tariff_id, threshold_kwh, rate_multiplier)
+//
+// day_mask is a bitmask over time.Weekday (bit 0 = Sunday .. bit 6 = Saturday);
+// start_min/end_min are minutes since local midnight, with end_min <= start_min
+// meaning the window wraps past midnight. billing_snapshots additionally
+// carries ratio_low_tariff_today (float) and energy_today_by_window (jsonb).
+// raw_readings additionally carries nullable energy_imported_t1_wh,
+// energy_imported_t2_wh, energy_exported_t1_wh, energy_exported_t2_wh bigint
+// columns alongside the legacy power_w/energy_wh columns, which are also
+// nullable now that a row only fills in the columns a reading actually had.
 type Database struct {
 	conn *sql.DB
 }
@@ -15,8 +32,69 @@ type Database struct {
 type Tariff struct {
 	ID        int
 	Name      string
-	BaseRate  float64
+	BaseRate  float64 // flat-rate fallback, used when no rate windows are configured
 	CO2Factor float64
+	Windows   []RateWindow
+	Tiers     []TariffTier
+}
+
+// RateWindow is one peak/off-peak window of a time-of-use tariff, e.g. "T1 peak"
+// weekdays 07:00-23:00 or "T2 off-peak" the rest of the time.
+type RateWindow struct {
+	Label      string
+	OffPeak    bool
+	DayMask    uint8 // bit i set (i = time.Sunday..time.Saturday) means the window applies on that weekday
+	StartMin   int   // minutes since local midnight, inclusive
+	EndMin     int   // minutes since local midnight, exclusive; EndMin <= StartMin means the window wraps past midnight
+	RatePerKWh float64
+}
+
+// Contains reports whether t falls inside the window, evaluated in t's own
+// location so DST transitions are handled by the time package rather than by
+// manual offset arithmetic.
+func (w RateWindow) Contains(t time.Time) bool {
+	if w.DayMask&(1<<uint(t.Weekday())) == 0 {
+		return false
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	if w.StartMin <= w.EndMin {
+		return minutes >= w.StartMin && minutes < w.EndMin
+	}
+	// wraps midnight: e.g. StartMin=22:00, EndMin=06:00
+	return minutes >= w.StartMin || minutes < w.EndMin
+}
+
+// TariffTier is one rung of a monthly kWh-tiered rate escalation: once the
+// monthly usage passed to TierMultiplier reaches ThresholdKWh, RateMultiplier
+// is applied on top of the window rate that would otherwise apply
+// (calculateAndPublishBilling passes its projected monthly kWh).
+type TariffTier struct {
+	ThresholdKWh   float64
+	RateMultiplier float64
+}
+
+// WindowAt returns the rate window covering t, or nil if t falls outside every
+// configured window (or the tariff has no windows, i.e. it is flat-rate).
+func (t *Tariff) WindowAt(at time.Time) *RateWindow {
+	for i := range t.Windows {
+		if t.Windows[i].Contains(at) {
+			return &t.Windows[i]
+		}
+	}
+	return nil
+}
+
+// TierMultiplier returns the escalation multiplier for a home whose
+// cumulative monthly usage is monthToDateKWh, i.e. the multiplier belonging to
+// the highest tier whose threshold has been crossed.
+func (t *Tariff) TierMultiplier(monthToDateKWh float64) float64 {
+	multiplier := 1.0
+	for _, tier := range t.Tiers {
+		if monthToDateKWh >= tier.ThresholdKWh {
+			multiplier = tier.RateMultiplier
+		}
+	}
+	return multiplier
 }
 
 func NewDatabase(config Config) (*Database, error) {
@@ -41,34 +119,94 @@ func (db *Database) Close() error {
 
 func (db *Database) GetActiveTariff(homeID string) (*Tariff, error) {
 	query := `
-		SELECT t.id, t.name, t.co2_factor_kg_per_kwh
+		SELECT t.id, t.name, t.co2_factor_kg_per_kwh, t.base_rate
 		FROM homes h
 		JOIN tariffs t ON h.active_tariff_id = t.id
 		WHERE h.id = $1
 	`
 
 	var tariff Tariff
-	err := db.conn.QueryRow(query, homeID).Scan(&tariff.ID, &tariff.Name, &tariff.CO2Factor)
+	err := db.conn.QueryRow(query, homeID).Scan(&tariff.ID, &tariff.Name, &tariff.CO2Factor, &tariff.BaseRate)
 	if err != nil {
 		return nil, err
 	}
 
-	// Simplified: use a base rate of $0.30/kWh
-	// In real implementation, calculate based on TOU and tier
-	tariff.BaseRate = 0.30
+	if tariff.Windows, err = db.getTariffRateWindows(tariff.ID); err != nil {
+		return nil, fmt.Errorf("failed to load rate windows for tariff %d: %w", tariff.ID, err)
+	}
+
+	if tariff.Tiers, err = db.getTariffTiers(tariff.ID); err != nil {
+		return nil, fmt.Errorf("failed to load tiers for tariff %d: %w", tariff.ID, err)
+	}
 
 	return &tariff, nil
 }
 
+func (db *Database) getTariffRateWindows(tariffID int) ([]RateWindow, error) {
+	query := `
+		SELECT label, off_peak, day_mask, start_min, end_min, rate_per_kwh
+		FROM tariff_rate_windows
+		WHERE tariff_id = $1
+		ORDER BY start_min
+	`
+
+	rows, err := db.conn.Query(query, tariffID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []RateWindow
+	for rows.Next() {
+		var w RateWindow
+		if err := rows.Scan(&w.Label, &w.OffPeak, &w.DayMask, &w.StartMin, &w.EndMin, &w.RatePerKWh); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, rows.Err()
+}
+
+func (db *Database) getTariffTiers(tariffID int) ([]TariffTier, error) {
+	query := `
+		SELECT threshold_kwh, rate_multiplier
+		FROM tariff_tiers
+		WHERE tariff_id = $1
+		ORDER BY threshold_kwh
+	`
+
+	rows, err := db.conn.Query(query, tariffID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tiers []TariffTier
+	for rows.Next() {
+		var t TariffTier
+		if err := rows.Scan(&t.ThresholdKWh, &t.RateMultiplier); err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, t)
+	}
+	return tiers, rows.Err()
+}
+
 func (db *Database) SaveBillingSnapshot(homeID string, data map[string]interface{}) error {
 	query := `
 		INSERT INTO billing_snapshots (
-			timestamp, home_id, cost_today, energy_today_kwh, 
-			projected_month, co2_today_kg, current_rate
-		) VALUES ($1, $2, $3, $4, $5, $6, $7)
+			timestamp, home_id, cost_today, energy_today_kwh,
+			projected_month, co2_today_kg, current_rate,
+			ratio_low_tariff_today, energy_today_by_window
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	`
 
-	_, err := db.conn.Exec(query,
+	byWindowJSON, err := json.Marshal(data["energy_today_by_window"])
+	if err != nil {
+		return fmt.Errorf("failed to marshal energy_today_by_window: %w", err)
+	}
+
+	_, err = db.conn.Exec(query,
 		time.Now(),
 		homeID,
 		data["cost_today"],
@@ -76,31 +214,123 @@ func (db *Database) SaveBillingSnapshot(homeID string, data map[string]interface
 		data["projected_month"],
 		data["co2_today_kg"],
 		data["current_rate"],
+		data["ratio_low_tariff_today"],
+		byWindowJSON,
 	)
 
 	return err
 }
 
+// SaveReading inserts only the columns this reading actually carries a value
+// for; a counter left nil is stored as NULL, so a publisher that omits
+// unchanged registers doesn't produce rows full of repeated values.
 func (db *Database) SaveReading(homeID string, reading PowerReading) error {
-	query := `
-		INSERT INTO raw_readings (timestamp, home_id, device_category, power_w, energy_wh)
-		VALUES ($1, $2, $3, $4, $5)
-	`
+	columns := []string{"timestamp", "home_id", "device_category"}
+	values := []interface{}{reading.Timestamp, homeID, reading.DeviceCategory}
 
-	_, err := db.conn.Exec(query,
-		reading.Timestamp,
-		homeID,
-		reading.DeviceCategory,
-		reading.PowerW,
-		reading.EnergyWh,
+	addCounter := func(column string, counter *int64) {
+		if counter != nil {
+			columns = append(columns, column)
+			values = append(values, *counter)
+		}
+	}
+	addCounter("energy_imported_t1_wh", reading.EnergyImportedT1Wh)
+	addCounter("energy_imported_t2_wh", reading.EnergyImportedT2Wh)
+	addCounter("energy_exported_t1_wh", reading.EnergyExportedT1Wh)
+	addCounter("energy_exported_t2_wh", reading.EnergyExportedT2Wh)
+
+	// Legacy compatibility: a PowerW-only payload has no counters at all, so
+	// the instantaneous fields are persisted whenever they are non-zero.
+	if reading.PowerW != 0 {
+		columns = append(columns, "power_w")
+		values = append(values, reading.PowerW)
+	}
+	if reading.EnergyWh != 0 {
+		columns = append(columns, "energy_wh")
+		values = append(values, reading.EnergyWh)
+	}
+
+	placeholders := make([]string, len(values))
+	for i := range values {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO raw_readings (%s) VALUES (%s)",
+		strings.Join(columns, ", "),
+		strings.Join(placeholders, ", "),
 	)
 
+	_, err := db.conn.Exec(query, values...)
 	return err
 }
 
+// QueryReadings returns raw readings for homeID in [from, to), oldest first.
+func (db *Database) QueryReadings(homeID string, from, to time.Time) ([]PowerReading, error) {
+	query := `
+		SELECT timestamp, device_category, power_w, energy_wh,
+		       energy_imported_t1_wh, energy_imported_t2_wh,
+		       energy_exported_t1_wh, energy_exported_t2_wh
+		FROM raw_readings
+		WHERE home_id = $1 AND timestamp >= $2 AND timestamp < $3
+		ORDER BY timestamp ASC
+	`
+
+	rows, err := db.conn.Query(query, homeID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var readings []PowerReading
+	for rows.Next() {
+		var r PowerReading
+		var powerW, energyWh sql.NullFloat64
+		var t1Imp, t2Imp, t1Exp, t2Exp sql.NullInt64
+		if err := rows.Scan(&r.Timestamp, &r.DeviceCategory, &powerW, &energyWh, &t1Imp, &t2Imp, &t1Exp, &t2Exp); err != nil {
+			return nil, err
+		}
+		r.PowerW = powerW.Float64
+		r.EnergyWh = energyWh.Float64
+		r.EnergyImportedT1Wh = nullInt64Ptr(t1Imp)
+		r.EnergyImportedT2Wh = nullInt64Ptr(t2Imp)
+		r.EnergyExportedT1Wh = nullInt64Ptr(t1Exp)
+		r.EnergyExportedT2Wh = nullInt64Ptr(t2Exp)
+		readings = append(readings, r)
+	}
+	return readings, rows.Err()
+}
+
+func nullInt64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// PowerReading is one MQTT sample for a device category. Devices reporting
+// like a P1 smart-meter logger set the EnergyImported/Exported counters,
+// which are cumulative lifetime register values in Wh (nil = that register
+// wasn't read this sample, e.g. the device only exposes some of the four).
+// PowerW/EnergyWh remain for legacy devices that only publish instantaneous
+// power/energy rather than cumulative counters; AddReading falls back to them
+// when none of the counters are present.
 type PowerReading struct {
 	Timestamp      time.Time `json:"timestamp"`
 	DeviceCategory string    `json:"device_category"`
 	PowerW         float64   `json:"power_w"`
 	EnergyWh       float64   `json:"energy_wh"`
+
+	// EnergyImportedT1Wh/EnergyImportedT2Wh are cumulative off-peak/peak
+	// register readings for energy drawn from the grid; EnergyExportedT1Wh/
+	// EnergyExportedT2Wh are the equivalent registers for energy fed back in
+	// (solar export). T1 is the off-peak register and T2 is the peak register;
+	// EnergyAccumulator.registerWindowLabel resolves each to whichever
+	// configured RateWindow has that OffPeak value, so the tariff's windows can
+	// be labeled anything ("T1 peak", "T2 off-peak", ...) and still bill
+	// correctly.
+	EnergyImportedT1Wh *int64 `json:"energy_imported_t1_wh,omitempty"`
+	EnergyImportedT2Wh *int64 `json:"energy_imported_t2_wh,omitempty"`
+	EnergyExportedT1Wh *int64 `json:"energy_exported_t1_wh,omitempty"`
+	EnergyExportedT2Wh *int64 `json:"energy_exported_t2_wh,omitempty"`
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("tzdata for %s not available in this environment: %v", name, err)
+	}
+	return loc
+}
+
+// weekdayMask sets the bits for every given weekday.
+func weekdayMask(days ...time.Weekday) uint8 {
+	var mask uint8
+	for _, d := range days {
+		mask |= 1 << uint(d)
+	}
+	return mask
+}
+
+func TestRateWindowContainsBoundaryCrossing(t *testing.T) {
+	loc := mustLoadLocation(t, "UTC")
+	allDays := weekdayMask(time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday)
+
+	// T1 peak 07:00-23:00, T2 off-peak the rest (wraps midnight).
+	peak := RateWindow{Label: "T1 peak", OffPeak: false, DayMask: allDays, StartMin: 7 * 60, EndMin: 23 * 60, RatePerKWh: 0.40}
+	offPeak := RateWindow{Label: "T2 off-peak", OffPeak: true, DayMask: allDays, StartMin: 23 * 60, EndMin: 7 * 60, RatePerKWh: 0.20}
+
+	cases := []struct {
+		name      string
+		t         time.Time
+		wantPeak  bool
+		wantOffPk bool
+	}{
+		{"one minute before peak starts", time.Date(2026, 3, 10, 6, 59, 0, 0, loc), false, true},
+		{"exactly at peak start", time.Date(2026, 3, 10, 7, 0, 0, 0, loc), true, false},
+		{"one minute before peak ends", time.Date(2026, 3, 10, 22, 59, 0, 0, loc), true, false},
+		{"exactly at peak end", time.Date(2026, 3, 10, 23, 0, 0, 0, loc), false, true},
+		{"just after midnight", time.Date(2026, 3, 10, 0, 30, 0, 0, loc), false, true},
+		{"just before midnight", time.Date(2026, 3, 10, 23, 59, 0, 0, loc), false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := peak.Contains(c.t); got != c.wantPeak {
+				t.Errorf("peak.Contains(%v) = %v, want %v", c.t, got, c.wantPeak)
+			}
+			if got := offPeak.Contains(c.t); got != c.wantOffPk {
+				t.Errorf("offPeak.Contains(%v) = %v, want %v", c.t, got, c.wantOffPk)
+			}
+		})
+	}
+}
+
+func TestRateWindowContainsDayMask(t *testing.T) {
+	loc := mustLoadLocation(t, "UTC")
+	weekdaysOnly := weekdayMask(time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday)
+	window := RateWindow{Label: "weekday peak", DayMask: weekdaysOnly, StartMin: 0, EndMin: 24 * 60, RatePerKWh: 0.40}
+
+	saturday := time.Date(2026, 3, 14, 12, 0, 0, 0, loc) // a Saturday
+	monday := time.Date(2026, 3, 16, 12, 0, 0, 0, loc)   // a Monday
+
+	if window.Contains(saturday) {
+		t.Errorf("window with weekday-only mask should not contain a Saturday reading")
+	}
+	if !window.Contains(monday) {
+		t.Errorf("window with weekday-only mask should contain a Monday reading")
+	}
+}
+
+func TestRateWindowContainsDSTTransition(t *testing.T) {
+	// US Eastern: clocks spring forward 02:00 -> 03:00 on 2026-03-08, and fall
+	// back 02:00 -> 01:00 on 2026-11-01. Contains buckets on t.Hour()/t.Minute()
+	// in t's own location, so it should track local wall-clock time straight
+	// through both transitions rather than drifting by the zone offset.
+	loc := mustLoadLocation(t, "America/New_York")
+	allDays := weekdayMask(time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday)
+	offPeak := RateWindow{Label: "T2 off-peak", OffPeak: true, DayMask: allDays, StartMin: 23 * 60, EndMin: 7 * 60, RatePerKWh: 0.20}
+
+	springForward := time.Date(2026, 3, 8, 3, 30, 0, 0, loc) // first local time after the spring-forward gap
+	if !offPeak.Contains(springForward) {
+		t.Errorf("expected local 03:30 to still be in the off-peak window across the spring-forward transition, got false")
+	}
+
+	fallBack := time.Date(2026, 11, 1, 1, 30, 0, 0, loc) // ambiguous local time, occurs twice
+	if !offPeak.Contains(fallBack) {
+		t.Errorf("expected local 01:30 to be in the off-peak window across the fall-back transition, got false")
+	}
+}
+
+func TestTariffWindowAtAndTierMultiplier(t *testing.T) {
+	loc := mustLoadLocation(t, "UTC")
+	allDays := weekdayMask(time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday)
+
+	tariff := &Tariff{
+		BaseRate: 0.30,
+		Windows: []RateWindow{
+			{Label: "T1 peak", OffPeak: false, DayMask: allDays, StartMin: 7 * 60, EndMin: 23 * 60, RatePerKWh: 0.40},
+			{Label: "T2 off-peak", OffPeak: true, DayMask: allDays, StartMin: 23 * 60, EndMin: 7 * 60, RatePerKWh: 0.20},
+		},
+		Tiers: []TariffTier{
+			{ThresholdKWh: 0, RateMultiplier: 1.0},
+			{ThresholdKWh: 300, RateMultiplier: 1.1},
+			{ThresholdKWh: 600, RateMultiplier: 1.25},
+		},
+	}
+
+	if w := tariff.WindowAt(time.Date(2026, 3, 10, 12, 0, 0, 0, loc)); w == nil || w.Label != "T1 peak" {
+		t.Errorf("WindowAt(noon) = %v, want T1 peak", w)
+	}
+	if w := tariff.WindowAt(time.Date(2026, 3, 10, 2, 0, 0, 0, loc)); w == nil || w.Label != "T2 off-peak" {
+		t.Errorf("WindowAt(02:00) = %v, want T2 off-peak", w)
+	}
+
+	if m := tariff.TierMultiplier(250); m != 1.0 {
+		t.Errorf("TierMultiplier(250) = %v, want 1.0", m)
+	}
+	if m := tariff.TierMultiplier(300); m != 1.1 {
+		t.Errorf("TierMultiplier(300) = %v, want 1.1", m)
+	}
+	if m := tariff.TierMultiplier(601); m != 1.25 {
+		t.Errorf("TierMultiplier(601) = %v, want 1.25", m)
+	}
+}
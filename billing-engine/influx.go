@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// InfluxStore is a Store backed by InfluxDB: readings and billing snapshots
+// are written as points, tagged by home_id (and device_category for
+// readings), rather than rows in a relational schema. Tariffs aren't
+// naturally time-series data, so they're kept as a single most-recent point
+// per home in the "tariffs" measurement, with the window/tier lists encoded
+// as a JSON field (Influx has no nested/array field type).
+type InfluxStore struct {
+	client   influxdb2.Client
+	writeAPI api.WriteAPIBlocking
+	queryAPI api.QueryAPI
+	org      string
+	bucket   string
+}
+
+func NewInfluxStore(config Config) (*InfluxStore, error) {
+	client := influxdb2.NewClient(config.InfluxURL, config.InfluxToken)
+
+	ok, err := client.Ping(context.Background())
+	if err != nil || !ok {
+		client.Close()
+		return nil, fmt.Errorf("failed to reach InfluxDB at %s: %w", config.InfluxURL, err)
+	}
+
+	return &InfluxStore{
+		client:   client,
+		writeAPI: client.WriteAPIBlocking(config.InfluxOrg, config.InfluxBucket),
+		queryAPI: client.QueryAPI(config.InfluxOrg),
+		org:      config.InfluxOrg,
+		bucket:   config.InfluxBucket,
+	}, nil
+}
+
+func (s *InfluxStore) Close() error {
+	s.client.Close()
+	return nil
+}
+
+func (s *InfluxStore) SaveReading(homeID string, reading PowerReading) error {
+	fields := map[string]interface{}{
+		"power_w":   reading.PowerW,
+		"energy_wh": reading.EnergyWh,
+	}
+	addIfPresent := func(field string, counter *int64) {
+		if counter != nil {
+			fields[field] = *counter
+		}
+	}
+	addIfPresent("energy_imported_t1_wh", reading.EnergyImportedT1Wh)
+	addIfPresent("energy_imported_t2_wh", reading.EnergyImportedT2Wh)
+	addIfPresent("energy_exported_t1_wh", reading.EnergyExportedT1Wh)
+	addIfPresent("energy_exported_t2_wh", reading.EnergyExportedT2Wh)
+
+	point := influxdb2.NewPoint("raw_readings",
+		map[string]string{"home_id": homeID, "device_category": reading.DeviceCategory},
+		fields,
+		reading.Timestamp,
+	)
+
+	return s.writeAPI.WritePoint(context.Background(), point)
+}
+
+func (s *InfluxStore) QueryReadings(homeID string, from, to time.Time) ([]PowerReading, error) {
+	flux := fmt.Sprintf(`
+		from(bucket: %q)
+			|> range(start: %s, stop: %s)
+			|> filter(fn: (r) => r._measurement == "raw_readings" and r.home_id == %q)
+			|> pivot(rowKey: ["_time", "device_category"], columnKey: ["_field"], valueColumn: "_value")
+			|> sort(columns: ["_time"])
+	`, s.bucket, from.Format(time.RFC3339), to.Format(time.RFC3339), homeID)
+
+	result, err := s.queryAPI.Query(context.Background(), flux)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var readings []PowerReading
+	for result.Next() {
+		rec := result.Record()
+		reading := PowerReading{
+			Timestamp:      rec.Time(),
+			DeviceCategory: fmt.Sprintf("%v", rec.ValueByKey("device_category")),
+		}
+		if v, ok := rec.ValueByKey("power_w").(float64); ok {
+			reading.PowerW = v
+		}
+		if v, ok := rec.ValueByKey("energy_wh").(float64); ok {
+			reading.EnergyWh = v
+		}
+		reading.EnergyImportedT1Wh = influxInt64Field(rec.ValueByKey("energy_imported_t1_wh"))
+		reading.EnergyImportedT2Wh = influxInt64Field(rec.ValueByKey("energy_imported_t2_wh"))
+		reading.EnergyExportedT1Wh = influxInt64Field(rec.ValueByKey("energy_exported_t1_wh"))
+		reading.EnergyExportedT2Wh = influxInt64Field(rec.ValueByKey("energy_exported_t2_wh"))
+		readings = append(readings, reading)
+	}
+	return readings, result.Err()
+}
+
+func influxInt64Field(v interface{}) *int64 {
+	switch n := v.(type) {
+	case int64:
+		return &n
+	case float64:
+		i := int64(n)
+		return &i
+	default:
+		return nil
+	}
+}
+
+func (s *InfluxStore) SaveBillingSnapshot(homeID string, data map[string]interface{}) error {
+	byWindowJSON, err := json.Marshal(data["energy_today_by_window"])
+	if err != nil {
+		return fmt.Errorf("failed to marshal energy_today_by_window: %w", err)
+	}
+
+	point := influxdb2.NewPoint("billing_snapshots",
+		map[string]string{"home_id": homeID},
+		map[string]interface{}{
+			"cost_today":             data["cost_today"],
+			"energy_today_kwh":       data["energy_today_kwh"],
+			"projected_month":        data["projected_month"],
+			"co2_today_kg":           data["co2_today_kg"],
+			"current_rate":           data["current_rate"],
+			"ratio_low_tariff_today": data["ratio_low_tariff_today"],
+			"energy_today_by_window": string(byWindowJSON),
+		},
+		time.Now(),
+	)
+
+	return s.writeAPI.WritePoint(context.Background(), point)
+}
+
+// QueryBillingHistory aggregates true per-interval deltas rather than the
+// last cumulative snapshot value in each window: energy_today_kwh/cost_today
+// are since-local-midnight running totals refreshed every 5 minutes by
+// billingLoop, so `aggregateWindow(fn: last)` over them directly would report
+// "total used so far today at the end of this window", not the energy
+// actually used during it.
+//
+// This mirrors the LAG-based per-day delta in timescale.go/sqlite.go: group by
+// calendar day (date.truncate, in UTC) so difference() restarts each day,
+// keepFirst so the first snapshot of a day (no prior point to diff against)
+// keeps a row, whose null difference the fallback map replaces with the raw
+// value, and nonNegative: false so a negative diff (the running total's
+// reset at local midnight, or a mid-day accumulator restart) also falls back
+// to the raw snapshot value - the same rollover guard as counterDeltaWh,
+// applied to a different monotonic counter.
+func (s *InfluxStore) QueryBillingHistory(homeID, resolution string, from, to time.Time, limit, offset int) ([]BillingHistoryBucket, error) {
+	window, ok := map[string]string{"1min": "1m", "hourly": "1h", "daily": "1d", "monthly": "1mo"}[resolution]
+	if !ok {
+		return nil, fmt.Errorf("unsupported resolution %q", resolution)
+	}
+
+	flux := fmt.Sprintf(`
+		import "date"
+
+		from(bucket: %q)
+			|> range(start: %s, stop: %s)
+			|> filter(fn: (r) => r._measurement == "billing_snapshots" and r.home_id == %q)
+			|> filter(fn: (r) => r._field == "energy_today_kwh" or r._field == "cost_today")
+			|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+			|> map(fn: (r) => ({ r with
+				day: date.truncate(t: r._time, unit: 1d),
+				energy_raw: r.energy_today_kwh,
+				cost_raw: r.cost_today,
+			}))
+			|> group(columns: ["day"])
+			|> sort(columns: ["_time"])
+			|> difference(columns: ["energy_today_kwh", "cost_today"], keepFirst: true, nonNegative: false)
+			|> map(fn: (r) => ({ r with
+				energy_today_kwh: if not exists r.energy_today_kwh or r.energy_today_kwh < 0.0 then r.energy_raw else r.energy_today_kwh,
+				cost_today: if not exists r.cost_today or r.cost_today < 0.0 then r.cost_raw else r.cost_today,
+			}))
+			|> group()
+			|> aggregateWindow(every: %s, fn: sum, createEmpty: false, columns: ["energy_today_kwh", "cost_today"])
+			|> sort(columns: ["_time"])
+			|> limit(n: %d, offset: %d)
+	`, s.bucket, from.Format(time.RFC3339), to.Format(time.RFC3339), homeID, window, limit, offset)
+
+	result, err := s.queryAPI.Query(context.Background(), flux)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var buckets []BillingHistoryBucket
+	for result.Next() {
+		rec := result.Record()
+		bucket := BillingHistoryBucket{Bucket: rec.Time()}
+		if v, ok := rec.ValueByKey("energy_today_kwh").(float64); ok {
+			bucket.EnergyKWh = v
+		}
+		if v, ok := rec.ValueByKey("cost_today").(float64); ok {
+			bucket.CostTotal = v
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, result.Err()
+}
+
+func (s *InfluxStore) GetActiveTariff(homeID string) (*Tariff, error) {
+	flux := fmt.Sprintf(`
+		from(bucket: %q)
+			|> range(start: -30d)
+			|> filter(fn: (r) => r._measurement == "tariffs" and r.home_id == %q)
+			|> last()
+			|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+	`, s.bucket, homeID)
+
+	result, err := s.queryAPI.Query(context.Background(), flux)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	if !result.Next() {
+		return nil, fmt.Errorf("no tariff found for home %s", homeID)
+	}
+	rec := result.Record()
+
+	tariff := &Tariff{Name: fmt.Sprintf("%v", rec.ValueByKey("name"))}
+	if v, ok := rec.ValueByKey("base_rate").(float64); ok {
+		tariff.BaseRate = v
+	}
+	if v, ok := rec.ValueByKey("co2_factor_kg_per_kwh").(float64); ok {
+		tariff.CO2Factor = v
+	}
+	if raw, ok := rec.ValueByKey("windows_json").(string); ok && raw != "" {
+		if err := json.Unmarshal([]byte(raw), &tariff.Windows); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal windows_json: %w", err)
+		}
+	}
+	if raw, ok := rec.ValueByKey("tiers_json").(string); ok && raw != "" {
+		if err := json.Unmarshal([]byte(raw), &tariff.Tiers); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tiers_json: %w", err)
+		}
+	}
+
+	return tariff, result.Err()
+}
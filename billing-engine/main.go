@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -16,32 +17,57 @@ import (
 )
 
 type Config struct {
-	MQTTBroker string
-	DBHost     string
-	DBPort     string
-	DBUser     string
-	DBPassword string
-	DBName     string
-	HomeID     string
+	MQTTBroker              string
+	DBHost                  string
+	DBPort                  string
+	DBUser                  string
+	DBPassword              string
+	DBName                  string
+	HomeID                  string
+	RawReadingRetentionDays int
+
+	// StorageBackend selects the Store implementation: "postgres" (default),
+	// "influxdb", or "sqlite". Only the fields for the selected backend need
+	// to be set.
+	StorageBackend string
+
+	InfluxURL    string
+	InfluxToken  string
+	InfluxOrg    string
+	InfluxBucket string
+
+	SQLitePath string
 }
 
 type BillingEngine struct {
-	config      Config
-	mqttClient  mqtt.Client
-	db          *Database
-	accumulator *EnergyAccumulator
-	httpServer  *http.Server
+	config        Config
+	mqttClient    mqtt.Client
+	subscriptions *subscriptionRegistry
+	mqttMetrics   *MQTTMetrics
+	db            Store
+	accumulator   *EnergyAccumulator
+	httpServer    *http.Server
 }
 
 func loadConfig() Config {
 	return Config{
-		MQTTBroker: getEnv("MQTT_BROKER", "localhost:1883"),
-		DBHost:     getEnv("DB_HOST", "localhost"),
-		DBPort:     getEnv("DB_PORT", "5432"),
-		DBUser:     getEnv("DB_USER", "postgres"),
-		DBPassword: getEnv("DB_PASSWORD", "oikosnomo_dev"),
-		DBName:     getEnv("DB_NAME", "oikosnomo"),
-		HomeID:     getEnv("HOME_ID", "home_001"),
+		MQTTBroker:              getEnv("MQTT_BROKER", "localhost:1883"),
+		DBHost:                  getEnv("DB_HOST", "localhost"),
+		DBPort:                  getEnv("DB_PORT", "5432"),
+		DBUser:                  getEnv("DB_USER", "postgres"),
+		DBPassword:              getEnv("DB_PASSWORD", "oikosnomo_dev"),
+		DBName:                  getEnv("DB_NAME", "oikosnomo"),
+		HomeID:                  getEnv("HOME_ID", "home_001"),
+		RawReadingRetentionDays: getEnvInt("RAW_READING_RETENTION_DAYS", 30),
+
+		StorageBackend: getEnv("STORAGE_BACKEND", "postgres"),
+
+		InfluxURL:    getEnv("INFLUX_URL", "http://localhost:8086"),
+		InfluxToken:  getEnv("INFLUX_TOKEN", ""),
+		InfluxOrg:    getEnv("INFLUX_ORG", "oikosnomo"),
+		InfluxBucket: getEnv("INFLUX_BUCKET", "oikosnomo"),
+
+		SQLitePath: getEnv("SQLITE_PATH", "./oikosnomo.db"),
 	}
 }
 
@@ -52,20 +78,35 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
 func main() {
 	log.Println("Starting OikosNomos Billing Engine...")
 
 	config := loadConfig()
 	engine := &BillingEngine{config: config}
 
-	// Initialize database
+	// Initialize storage backend
 	var err error
-	engine.db, err = NewDatabase(config)
+	engine.db, err = NewStore(config)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		log.Fatalf("Failed to initialize %s storage: %v", config.StorageBackend, err)
 	}
 	defer engine.db.Close()
-	log.Println("Database connected")
+	log.Printf("Storage backend %q connected", config.StorageBackend)
+
+	if pg, ok := engine.db.(*Database); ok {
+		if err := pg.setupTimescale(config.RawReadingRetentionDays); err != nil {
+			log.Printf("Failed to set up TimescaleDB: %v", err)
+		}
+	}
 
 	// Initialize energy accumulator
 	engine.accumulator = NewEnergyAccumulator(config.HomeID, engine.db)
@@ -93,42 +134,6 @@ func main() {
 	engine.httpServer.Shutdown(nil)
 }
 
-func (e *BillingEngine) setupMQTT() error {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s", e.config.MQTTBroker))
-	opts.SetClientID("billing-engine")
-	opts.SetDefaultPublishHandler(e.messageHandler)
-	opts.SetOnConnectHandler(func(c mqtt.Client) {
-		log.Println("MQTT connected, subscribing to topics...")
-		// Subscribe to all device power topics
-		topic := fmt.Sprintf("home/%s/device/+/power", e.config.HomeID)
-		if token := c.Subscribe(topic, 0, nil); token.Wait() && token.Error() != nil {
-			log.Printf("Failed to subscribe to %s: %v", topic, token.Error())
-		} else {
-			log.Printf("Subscribed to %s", topic)
-		}
-	})
-
-	e.mqttClient = mqtt.NewClient(opts)
-	if token := e.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
-	}
-
-	return nil
-}
-
-func (e *BillingEngine) messageHandler(client mqtt.Client, msg mqtt.Message) {
-	// Parse power reading
-	var reading PowerReading
-	if err := json.Unmarshal(msg.Payload(), &reading); err != nil {
-		log.Printf("Failed to parse message: %v", err)
-		return
-	}
-
-	// Add to accumulator
-	e.accumulator.AddReading(reading)
-}
-
 func (e *BillingEngine) billingLoop() {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
@@ -143,47 +148,82 @@ func (e *BillingEngine) billingLoop() {
 func (e *BillingEngine) calculateAndPublishBilling() error {
 	log.Println("Calculating billing...")
 
-	// Get accumulated energy for today
-	todayEnergy := e.accumulator.GetTodayTotal()
-
 	// Get tariff
 	tariff, err := e.db.GetActiveTariff(e.config.HomeID)
 	if err != nil {
 		return fmt.Errorf("failed to get tariff: %w", err)
 	}
+	e.accumulator.SetTariffWindows(tariff.Windows)
 
-	// Calculate cost (simplified - in real implementation, apply TOU logic)
-	costToday := todayEnergy * tariff.BaseRate
+	// Get accumulated energy for today, partitioned by tariff rate window
+	todayEnergy := e.accumulator.GetTodayTotal()
+
+	// Apply TOU windows: each bucket is billed at its own window's rate. A
+	// flat-rate tariff (no windows configured) falls back to BaseRate via the
+	// unmetered bucket.
+	costToday := 0.0
+	offPeakKWh := 0.0
+	for label, kwh := range todayEnergy.ByWindow {
+		rate := tariff.BaseRate
+		offPeak := false
+		for _, w := range tariff.Windows {
+			if w.Label == label {
+				rate = w.RatePerKWh
+				offPeak = w.OffPeak
+				break
+			}
+		}
+		costToday += kwh * rate
+		if offPeak {
+			offPeakKWh += kwh
+		}
+	}
 
 	// Project monthly
 	daysInMonth := 30.0
 	dayOfMonth := float64(time.Now().Day())
 	projectedMonth := (costToday / dayOfMonth) * daysInMonth
+	projectedMonthKWh := (todayEnergy.TotalKWh / dayOfMonth) * daysInMonth
+
+	// Tiered escalation: scale cost by the multiplier for the tier that
+	// projected monthly usage has reached.
+	costToday *= tariff.TierMultiplier(projectedMonthKWh)
+	projectedMonth *= tariff.TierMultiplier(projectedMonthKWh)
+
+	ratioLowTariffToday := 0.0
+	if todayEnergy.TotalKWh > 0 {
+		ratioLowTariffToday = offPeakKWh / todayEnergy.TotalKWh
+	}
 
 	// Calculate CO2
-	co2Today := todayEnergy * tariff.CO2Factor
+	co2Today := todayEnergy.TotalKWh * tariff.CO2Factor
 
 	// Publish to MQTT
 	billingData := map[string]interface{}{
-		"timestamp":        time.Now().Format(time.RFC3339),
-		"cost_today":       costToday,
-		"energy_today_kwh": todayEnergy,
-		"projected_month":  projectedMonth,
-		"co2_today_kg":     co2Today,
-		"current_rate":     tariff.BaseRate,
+		"timestamp":              time.Now().Format(time.RFC3339),
+		"cost_today":             costToday,
+		"energy_today_kwh":       todayEnergy.TotalKWh,
+		"energy_today_by_window": todayEnergy.ByWindow,
+		"ratio_low_tariff_today": ratioLowTariffToday,
+		"projected_month":        projectedMonth,
+		"co2_today_kg":           co2Today,
+		"current_rate":           tariff.BaseRate,
 	}
 
 	payload, _ := json.Marshal(billingData)
 	topic := fmt.Sprintf("home/%s/billing/today_cost", e.config.HomeID)
-	e.mqttClient.Publish(topic, 0, false, payload)
+	// QoS 1 + retained so a subscriber that reconnects (or only just came
+	// online) immediately sees the current billing state rather than waiting
+	// up to 5 minutes for the next tick.
+	e.mqttClient.Publish(topic, 1, true, payload)
 
 	// Save to database
 	if err := e.db.SaveBillingSnapshot(e.config.HomeID, billingData); err != nil {
 		log.Printf("Failed to save billing snapshot: %v", err)
 	}
 
-	log.Printf("Billing calculated: Today=$%.2f, Projected=$%.2f, Energy=%.2fkWh",
-		costToday, projectedMonth, todayEnergy)
+	log.Printf("Billing calculated: Today=$%.2f, Projected=$%.2f, Energy=%.2fkWh, LowTariffRatio=%.2f",
+		costToday, projectedMonth, todayEnergy.TotalKWh, ratioLowTariffToday)
 
 	return nil
 }
@@ -209,28 +249,116 @@ func (e *BillingEngine) setupHTTP() {
 
 func (e *BillingEngine) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "healthy",
+		"mqtt":   e.mqttMetrics.Snapshot(),
+	})
 }
 
 func (e *BillingEngine) currentBillingHandler(w http.ResponseWriter, r *http.Request) {
 	todayEnergy := e.accumulator.GetTodayTotal()
 	tariff, _ := e.db.GetActiveTariff(e.config.HomeID)
 
-	costToday := todayEnergy * tariff.BaseRate
+	costToday := 0.0
+	offPeakKWh := 0.0
+	for label, kwh := range todayEnergy.ByWindow {
+		rate := tariff.BaseRate
+		offPeak := false
+		for _, win := range tariff.Windows {
+			if win.Label == label {
+				rate = win.RatePerKWh
+				offPeak = win.OffPeak
+				break
+			}
+		}
+		costToday += kwh * rate
+		if offPeak {
+			offPeakKWh += kwh
+		}
+	}
 	projectedMonth := (costToday / float64(time.Now().Day())) * 30.0
 
+	ratioLowTariffToday := 0.0
+	if todayEnergy.TotalKWh > 0 {
+		ratioLowTariffToday = offPeakKWh / todayEnergy.TotalKWh
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"home_id":          e.config.HomeID,
-		"cost_today":       costToday,
-		"energy_today_kwh": todayEnergy,
-		"projected_month":  projectedMonth,
-		"tariff":           tariff.Name,
+		"home_id":                e.config.HomeID,
+		"cost_today":             costToday,
+		"energy_today_kwh":       todayEnergy.TotalKWh,
+		"energy_today_by_window": todayEnergy.ByWindow,
+		"ratio_low_tariff_today": ratioLowTariffToday,
+		"projected_month":        projectedMonth,
+		"tariff":                 tariff.Name,
 	})
 }
 
 func (e *BillingEngine) billingHistoryHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement history query from database
+	resolution := r.URL.Query().Get("resolution")
+	if resolution == "" {
+		resolution = "hourly"
+	}
+	if _, ok := continuousAggregateNames[resolution]; !ok {
+		http.Error(w, fmt.Sprintf("unsupported resolution %q", resolution), http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	if v := r.URL.Query().Get("to"); v != "" {
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid to: must be RFC3339", http.StatusBadRequest)
+			return
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, -7)
+	if v := r.URL.Query().Get("from"); v != "" {
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid from: must be RFC3339", http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	}
+
+	page := 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			http.Error(w, "invalid page: must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		page = parsed
+	}
+
+	pageSize := 100
+	if v := r.URL.Query().Get("page_size"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			http.Error(w, "invalid page_size: must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		pageSize = parsed
+	}
+
+	buckets, err := e.db.QueryBillingHistory(e.config.HomeID, resolution, from, to, pageSize, (page-1)*pageSize)
+	if err != nil {
+		log.Printf("Failed to query billing history: %v", err)
+		http.Error(w, "failed to query billing history", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode([]interface{}{})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"resolution": resolution,
+		"from":       from.Format(time.RFC3339),
+		"to":         to.Format(time.RFC3339),
+		"page":       page,
+		"page_size":  pageSize,
+		"buckets":    buckets,
+	})
 }
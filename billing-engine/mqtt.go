@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTMetrics tracks connection-health counters surfaced on /health.
+type MQTTMetrics struct {
+	Reconnects           int64
+	DroppedMessages      int64
+	SubscriptionFailures int64
+}
+
+func (m *MQTTMetrics) Snapshot() map[string]int64 {
+	return map[string]int64{
+		"reconnects":            atomic.LoadInt64(&m.Reconnects),
+		"dropped_messages":      atomic.LoadInt64(&m.DroppedMessages),
+		"subscription_failures": atomic.LoadInt64(&m.SubscriptionFailures),
+	}
+}
+
+// subscriptionRegistry tracks which topics the engine should be subscribed
+// to, so they can all be re-subscribed after a reconnect (a fresh MQTT
+// session carries none of the old subscriptions) and so new device
+// categories can be added at runtime.
+type subscriptionRegistry struct {
+	mu     sync.Mutex
+	topics map[string]byte // topic -> QoS
+}
+
+func newSubscriptionRegistry() *subscriptionRegistry {
+	return &subscriptionRegistry{topics: make(map[string]byte)}
+}
+
+func (r *subscriptionRegistry) add(topic string, qos byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.topics[topic] = qos
+}
+
+func (r *subscriptionRegistry) all() map[string]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]byte, len(r.topics))
+	for topic, qos := range r.topics {
+		out[topic] = qos
+	}
+	return out
+}
+
+func (e *BillingEngine) setupMQTT() error {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://%s", e.config.MQTTBroker))
+	opts.SetClientID("billing-engine")
+	opts.SetDefaultPublishHandler(e.messageHandler)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetKeepAlive(30 * time.Second)
+	opts.SetReconnectingHandler(func(c mqtt.Client, o *mqtt.ClientOptions) {
+		atomic.AddInt64(&e.mqttMetrics.Reconnects, 1)
+		log.Println("MQTT reconnecting...")
+	})
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Println("MQTT connected, (re)establishing subscriptions...")
+		e.resubscribeAll()
+	})
+
+	e.mqttMetrics = &MQTTMetrics{}
+	e.subscriptions = newSubscriptionRegistry()
+	e.subscriptions.add(fmt.Sprintf("home/%s/device/+/power", e.config.HomeID), 1)
+
+	e.mqttClient = mqtt.NewClient(opts)
+	if token := e.mqttClient.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
+
+// resubscribeAll (re)subscribes to every topic in the registry. It runs from
+// OnConnectHandler on every (re)connect, not just the first, since paho does
+// not remember subscriptions across a dropped session on its own.
+func (e *BillingEngine) resubscribeAll() {
+	for topic, qos := range e.subscriptions.all() {
+		if token := e.mqttClient.Subscribe(topic, qos, nil); token.Wait() && token.Error() != nil {
+			atomic.AddInt64(&e.mqttMetrics.SubscriptionFailures, 1)
+			log.Printf("Failed to subscribe to %s: %v", topic, token.Error())
+			continue
+		}
+		log.Printf("Subscribed to %s (QoS %d)", topic, qos)
+	}
+}
+
+// SubscribeDeviceCategory adds a topic for a newly provisioned device
+// category at runtime, without requiring a restart.
+func (e *BillingEngine) SubscribeDeviceCategory(category string) error {
+	topic := fmt.Sprintf("home/%s/device/%s/power", e.config.HomeID, category)
+	e.subscriptions.add(topic, 1)
+
+	if token := e.mqttClient.Subscribe(topic, 1, nil); token.Wait() && token.Error() != nil {
+		atomic.AddInt64(&e.mqttMetrics.SubscriptionFailures, 1)
+		return token.Error()
+	}
+	log.Printf("Subscribed to %s (QoS 1)", topic)
+	return nil
+}
+
+func (e *BillingEngine) messageHandler(client mqtt.Client, msg mqtt.Message) {
+	// Parse power reading
+	var reading PowerReading
+	if err := json.Unmarshal(msg.Payload(), &reading); err != nil {
+		atomic.AddInt64(&e.mqttMetrics.DroppedMessages, 1)
+		log.Printf("Failed to parse message: %v", err)
+		return
+	}
+
+	// Add to accumulator
+	e.accumulator.AddReading(reading)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore is a Store for single-home installs that don't run a separate
+// Postgres server. Unlike the Postgres schema, rate windows/tiers are kept as
+// JSON text columns directly on the tariffs row rather than normalized join
+// tables - a single-home SQLite file doesn't need to query across tariffs, so
+// there's nothing the normalization would buy.
+type SQLiteStore struct {
+	conn *sql.DB
+}
+
+func NewSQLiteStore(config Config) (*SQLiteStore, error) {
+	conn, err := sql.Open("sqlite3", config.SQLitePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Ping(); err != nil {
+		return nil, err
+	}
+
+	s := &SQLiteStore{conn: conn}
+	if err := s.migrate(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to migrate sqlite schema: %w", err)
+	}
+	return s, nil
+}
+
+func (s *SQLiteStore) migrate() error {
+	_, err := s.conn.Exec(`
+		CREATE TABLE IF NOT EXISTS tariffs (
+			home_id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			base_rate REAL NOT NULL,
+			co2_factor_kg_per_kwh REAL NOT NULL,
+			windows_json TEXT NOT NULL DEFAULT '[]',
+			tiers_json TEXT NOT NULL DEFAULT '[]'
+		);
+
+		CREATE TABLE IF NOT EXISTS raw_readings (
+			timestamp TEXT NOT NULL,
+			home_id TEXT NOT NULL,
+			device_category TEXT NOT NULL,
+			power_w REAL,
+			energy_wh REAL,
+			energy_imported_t1_wh INTEGER,
+			energy_imported_t2_wh INTEGER,
+			energy_exported_t1_wh INTEGER,
+			energy_exported_t2_wh INTEGER
+		);
+		CREATE INDEX IF NOT EXISTS idx_raw_readings_home_ts ON raw_readings (home_id, timestamp);
+
+		CREATE TABLE IF NOT EXISTS billing_snapshots (
+			timestamp TEXT NOT NULL,
+			home_id TEXT NOT NULL,
+			cost_today REAL,
+			energy_today_kwh REAL,
+			projected_month REAL,
+			co2_today_kg REAL,
+			current_rate REAL,
+			ratio_low_tariff_today REAL,
+			energy_today_by_window TEXT
+		);
+		CREATE INDEX IF NOT EXISTS idx_billing_snapshots_home_ts ON billing_snapshots (home_id, timestamp);
+	`)
+	return err
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.conn.Close()
+}
+
+func (s *SQLiteStore) GetActiveTariff(homeID string) (*Tariff, error) {
+	var tariff Tariff
+	var windowsJSON, tiersJSON string
+
+	query := `SELECT name, base_rate, co2_factor_kg_per_kwh, windows_json, tiers_json FROM tariffs WHERE home_id = ?`
+	err := s.conn.QueryRow(query, homeID).Scan(&tariff.Name, &tariff.BaseRate, &tariff.CO2Factor, &windowsJSON, &tiersJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(windowsJSON), &tariff.Windows); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal windows_json: %w", err)
+	}
+	if err := json.Unmarshal([]byte(tiersJSON), &tariff.Tiers); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tiers_json: %w", err)
+	}
+
+	return &tariff, nil
+}
+
+func (s *SQLiteStore) SaveReading(homeID string, reading PowerReading) error {
+	columns := []string{"timestamp", "home_id", "device_category"}
+	values := []interface{}{reading.Timestamp.Format(time.RFC3339), homeID, reading.DeviceCategory}
+
+	addCounter := func(column string, counter *int64) {
+		if counter != nil {
+			columns = append(columns, column)
+			values = append(values, *counter)
+		}
+	}
+	addCounter("energy_imported_t1_wh", reading.EnergyImportedT1Wh)
+	addCounter("energy_imported_t2_wh", reading.EnergyImportedT2Wh)
+	addCounter("energy_exported_t1_wh", reading.EnergyExportedT1Wh)
+	addCounter("energy_exported_t2_wh", reading.EnergyExportedT2Wh)
+	if reading.PowerW != 0 {
+		columns = append(columns, "power_w")
+		values = append(values, reading.PowerW)
+	}
+	if reading.EnergyWh != 0 {
+		columns = append(columns, "energy_wh")
+		values = append(values, reading.EnergyWh)
+	}
+
+	placeholders := make([]string, len(values))
+	for i := range values {
+		placeholders[i] = "?"
+	}
+
+	query := fmt.Sprintf("INSERT INTO raw_readings (%s) VALUES (%s)", strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	_, err := s.conn.Exec(query, values...)
+	return err
+}
+
+func (s *SQLiteStore) QueryReadings(homeID string, from, to time.Time) ([]PowerReading, error) {
+	query := `
+		SELECT timestamp, device_category, power_w, energy_wh,
+		       energy_imported_t1_wh, energy_imported_t2_wh,
+		       energy_exported_t1_wh, energy_exported_t2_wh
+		FROM raw_readings
+		WHERE home_id = ? AND timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp ASC
+	`
+	rows, err := s.conn.Query(query, homeID, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var readings []PowerReading
+	for rows.Next() {
+		var r PowerReading
+		var timestamp string
+		var powerW, energyWh sql.NullFloat64
+		var t1Imp, t2Imp, t1Exp, t2Exp sql.NullInt64
+		if err := rows.Scan(&timestamp, &r.DeviceCategory, &powerW, &energyWh, &t1Imp, &t2Imp, &t1Exp, &t2Exp); err != nil {
+			return nil, err
+		}
+		r.Timestamp, err = time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		r.PowerW = powerW.Float64
+		r.EnergyWh = energyWh.Float64
+		r.EnergyImportedT1Wh = nullInt64Ptr(t1Imp)
+		r.EnergyImportedT2Wh = nullInt64Ptr(t2Imp)
+		r.EnergyExportedT1Wh = nullInt64Ptr(t1Exp)
+		r.EnergyExportedT2Wh = nullInt64Ptr(t2Exp)
+		readings = append(readings, r)
+	}
+	return readings, rows.Err()
+}
+
+func (s *SQLiteStore) SaveBillingSnapshot(homeID string, data map[string]interface{}) error {
+	byWindowJSON, err := json.Marshal(data["energy_today_by_window"])
+	if err != nil {
+		return fmt.Errorf("failed to marshal energy_today_by_window: %w", err)
+	}
+
+	query := `
+		INSERT INTO billing_snapshots (
+			timestamp, home_id, cost_today, energy_today_kwh,
+			projected_month, co2_today_kg, current_rate,
+			ratio_low_tariff_today, energy_today_by_window
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = s.conn.Exec(query,
+		time.Now().Format(time.RFC3339),
+		homeID,
+		data["cost_today"],
+		data["energy_today_kwh"],
+		data["projected_month"],
+		data["co2_today_kg"],
+		data["current_rate"],
+		data["ratio_low_tariff_today"],
+		string(byWindowJSON),
+	)
+	return err
+}
+
+// QueryBillingHistory aggregates true per-interval deltas rather than summing
+// energy_today_kwh/cost_today directly: those columns are cumulative
+// since-local-midnight running totals refreshed every 5 minutes by
+// billingLoop, so summing them as-is would inflate every resolution's totals
+// by roughly the number of snapshot ticks in the bucket. The deltas CTE diffs
+// each snapshot against the previous one on the same calendar day (LAG,
+// partitioned by day so the running total's own midnight reset isn't read as
+// a negative delta); normalized then applies the same rollover guard as
+// counterDeltaWh - a NULL or negative delta means either the first snapshot
+// of the day or a reset, so the running total itself is the only energy we
+// can account for.
+func (s *SQLiteStore) QueryBillingHistory(homeID, resolution string, from, to time.Time, limit, offset int) ([]BillingHistoryBucket, error) {
+	bucketExpr, ok := map[string]string{
+		"1min":    "strftime('%Y-%m-%dT%H:%M:00Z', timestamp)",
+		"hourly":  "strftime('%Y-%m-%dT%H:00:00Z', timestamp)",
+		"daily":   "strftime('%Y-%m-%dT00:00:00Z', timestamp)",
+		"monthly": "strftime('%Y-%m-01T00:00:00Z', timestamp)",
+	}[resolution]
+	if !ok {
+		return nil, fmt.Errorf("unsupported resolution %q", resolution)
+	}
+
+	query := fmt.Sprintf(`
+		WITH deltas AS (
+			SELECT
+				timestamp,
+				energy_today_kwh,
+				cost_today,
+				energy_today_kwh - LAG(energy_today_kwh) OVER (PARTITION BY strftime('%%Y-%%m-%%d', timestamp) ORDER BY timestamp) AS energy_delta_raw,
+				cost_today - LAG(cost_today) OVER (PARTITION BY strftime('%%Y-%%m-%%d', timestamp) ORDER BY timestamp) AS cost_delta_raw
+			FROM billing_snapshots
+			WHERE home_id = ? AND timestamp >= ? AND timestamp < ?
+		),
+		normalized AS (
+			SELECT
+				timestamp,
+				CASE WHEN energy_delta_raw IS NULL OR energy_delta_raw < 0 THEN energy_today_kwh ELSE energy_delta_raw END AS energy_delta,
+				CASE WHEN cost_delta_raw IS NULL OR cost_delta_raw < 0 THEN cost_today ELSE cost_delta_raw END AS cost_delta
+			FROM deltas
+		)
+		SELECT %s AS bucket, sum(energy_delta), sum(cost_delta)
+		FROM normalized
+		GROUP BY bucket
+		ORDER BY bucket ASC
+		LIMIT ? OFFSET ?
+	`, bucketExpr)
+
+	rows, err := s.conn.Query(query, homeID, from.Format(time.RFC3339), to.Format(time.RFC3339), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []BillingHistoryBucket
+	for rows.Next() {
+		var bucketStr string
+		var b BillingHistoryBucket
+		if err := rows.Scan(&bucketStr, &b.EnergyKWh, &b.CostTotal); err != nil {
+			return nil, err
+		}
+		b.Bucket, err = time.Parse(time.RFC3339, bucketStr)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// TariffStore resolves a home's active tariff.
+type TariffStore interface {
+	GetActiveTariff(homeID string) (*Tariff, error)
+}
+
+// ReadingStore persists and queries raw power readings.
+type ReadingStore interface {
+	SaveReading(homeID string, reading PowerReading) error
+	QueryReadings(homeID string, from, to time.Time) ([]PowerReading, error)
+}
+
+// BillingStore persists billing snapshots and serves history queries.
+type BillingStore interface {
+	SaveBillingSnapshot(homeID string, data map[string]interface{}) error
+	QueryBillingHistory(homeID, resolution string, from, to time.Time, limit, offset int) ([]BillingHistoryBucket, error)
+}
+
+// Store is the full persistence surface a backend must provide. BillingEngine
+// holds a Store, since it uses every part of it including Close;
+// EnergyAccumulator depends only on the narrower ReadingStore.
+type Store interface {
+	TariffStore
+	ReadingStore
+	BillingStore
+	Close() error
+}
+
+// NewStore builds the configured storage backend. STORAGE_BACKEND selects
+// between "postgres" (default), "influxdb", and "sqlite".
+func NewStore(config Config) (Store, error) {
+	switch config.StorageBackend {
+	case "", "postgres":
+		return NewDatabase(config)
+	case "influxdb":
+		return NewInfluxStore(config)
+	case "sqlite":
+		return NewSQLiteStore(config)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q (want postgres, influxdb, or sqlite)", config.StorageBackend)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runStoreConformanceTests exercises the ReadingStore/BillingStore contract
+// any Store implementation must satisfy, regardless of backend. GetActiveTariff
+// is deliberately not covered here: each backend seeds/shapes tariff data
+// differently enough (Postgres joins through a homes table, SQLite/InfluxDB
+// keep it as a single row/point) that a shared conformance test would mostly
+// be testing backend-specific setup rather than shared behavior.
+func runStoreConformanceTests(t *testing.T, store Store, homeID string) {
+	t.Helper()
+
+	from := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	legacy := PowerReading{
+		Timestamp:      from.Add(1 * time.Minute),
+		DeviceCategory: "main",
+		PowerW:         720,
+		EnergyWh:       12,
+	}
+	t1 := int64(1000)
+	t2 := int64(500)
+	counters := PowerReading{
+		Timestamp:          from.Add(2 * time.Minute),
+		DeviceCategory:     "main",
+		EnergyImportedT1Wh: &t1,
+		EnergyImportedT2Wh: &t2,
+	}
+
+	if err := store.SaveReading(homeID, legacy); err != nil {
+		t.Fatalf("SaveReading(legacy) = %v", err)
+	}
+	if err := store.SaveReading(homeID, counters); err != nil {
+		t.Fatalf("SaveReading(counters) = %v", err)
+	}
+
+	readings, err := store.QueryReadings(homeID, from, from.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("QueryReadings = %v", err)
+	}
+	if len(readings) != 2 {
+		t.Fatalf("QueryReadings returned %d readings, want 2", len(readings))
+	}
+	if readings[0].PowerW != legacy.PowerW {
+		t.Errorf("readings[0].PowerW = %v, want %v", readings[0].PowerW, legacy.PowerW)
+	}
+	if readings[1].EnergyImportedT1Wh == nil || *readings[1].EnergyImportedT1Wh != t1 {
+		t.Errorf("readings[1].EnergyImportedT1Wh = %v, want %v", readings[1].EnergyImportedT1Wh, t1)
+	}
+
+	snapshot := map[string]interface{}{
+		"cost_today":             1.5,
+		"energy_today_kwh":       5.0,
+		"projected_month":        45.0,
+		"co2_today_kg":           2.0,
+		"current_rate":           0.30,
+		"ratio_low_tariff_today": 0.4,
+		"energy_today_by_window": map[string]float64{"T1 peak": 3.0, "T2 off-peak": 2.0},
+	}
+	if err := store.SaveBillingSnapshot(homeID, snapshot); err != nil {
+		t.Fatalf("SaveBillingSnapshot = %v", err)
+	}
+
+	for _, resolution := range []string{"1min", "hourly", "daily", "monthly"} {
+		if _, err := store.QueryBillingHistory(homeID, resolution, from.AddDate(0, -1, 0), from.AddDate(0, 1, 0), 10, 0); err != nil {
+			t.Errorf("QueryBillingHistory(%q) = %v", resolution, err)
+		}
+	}
+
+	if _, err := store.QueryBillingHistory(homeID, "not_a_resolution", from, from.Add(time.Hour), 10, 0); err == nil {
+		t.Errorf("QueryBillingHistory(unsupported resolution) returned no error, want one")
+	}
+}
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	config := Config{SQLitePath: filepath.Join(t.TempDir(), "conformance.db")}
+	store, err := NewSQLiteStore(config)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore = %v", err)
+	}
+	defer store.Close()
+
+	runStoreConformanceTests(t, store, "home_conformance")
+}
+
+// TestPostgresStoreConformance only runs against a live Postgres instance
+// provisioned with this project's schema, since unlike SQLite it has no
+// embedded/in-process mode. Set TEST_POSTGRES_HOST (and friends) to opt in;
+// CI without a Postgres available skips it rather than failing.
+func TestPostgresStoreConformance(t *testing.T) {
+	host := os.Getenv("TEST_POSTGRES_HOST")
+	if host == "" {
+		t.Skip("TEST_POSTGRES_HOST not set, skipping Postgres conformance test")
+	}
+
+	config := Config{
+		DBHost:     host,
+		DBPort:     getEnv("TEST_POSTGRES_PORT", "5432"),
+		DBUser:     getEnv("TEST_POSTGRES_USER", "postgres"),
+		DBPassword: getEnv("TEST_POSTGRES_PASSWORD", "oikosnomo_dev"),
+		DBName:     getEnv("TEST_POSTGRES_DBNAME", "oikosnomo"),
+	}
+	store, err := NewDatabase(config)
+	if err != nil {
+		t.Fatalf("NewDatabase = %v", err)
+	}
+	defer store.Close()
+
+	runStoreConformanceTests(t, store, "home_conformance")
+}
+
+// TestInfluxStoreConformance only runs against a live InfluxDB instance; set
+// TEST_INFLUX_URL (and friends) to opt in.
+func TestInfluxStoreConformance(t *testing.T) {
+	url := os.Getenv("TEST_INFLUX_URL")
+	if url == "" {
+		t.Skip("TEST_INFLUX_URL not set, skipping InfluxDB conformance test")
+	}
+
+	config := Config{
+		InfluxURL:    url,
+		InfluxToken:  os.Getenv("TEST_INFLUX_TOKEN"),
+		InfluxOrg:    getEnv("TEST_INFLUX_ORG", "oikosnomo"),
+		InfluxBucket: getEnv("TEST_INFLUX_BUCKET", "oikosnomo"),
+	}
+	store, err := NewInfluxStore(config)
+	if err != nil {
+		t.Fatalf("NewInfluxStore = %v", err)
+	}
+	defer store.Close()
+
+	runStoreConformanceTests(t, store, "home_conformance")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// setupTimescale converts raw_readings and billing_snapshots into TimescaleDB
+// hypertables and provisions continuous aggregates + a retention policy, when
+// the timescaledb extension is available. On a plain Postgres install (no
+// extension) it logs and leaves the tables as ordinary tables - readings and
+// billing snapshots still work, just without rollups or auto-retention.
+func (db *Database) setupTimescale(retentionDays int) error {
+	hasExtension, err := db.ensureTimescaleExtension()
+	if err != nil {
+		return fmt.Errorf("failed to check for timescaledb extension: %w", err)
+	}
+	if !hasExtension {
+		log.Println("timescaledb extension not available, falling back to plain tables")
+		return nil
+	}
+
+	hypertables := []struct {
+		table    string
+		timeCol  string
+		chunkArg string
+	}{
+		{"raw_readings", "timestamp", "INTERVAL '1 day'"},
+		{"billing_snapshots", "timestamp", "INTERVAL '7 days'"},
+	}
+	for _, ht := range hypertables {
+		query := fmt.Sprintf(
+			`SELECT create_hypertable('%s', '%s', chunk_time_interval => %s, if_not_exists => TRUE, migrate_data => TRUE)`,
+			ht.table, ht.timeCol, ht.chunkArg,
+		)
+		if _, err := db.conn.Exec(query); err != nil {
+			return fmt.Errorf("failed to create hypertable %s: %w", ht.table, err)
+		}
+	}
+
+	if err := db.createContinuousAggregates(); err != nil {
+		return fmt.Errorf("failed to create continuous aggregates: %w", err)
+	}
+
+	if retentionDays > 0 {
+		query := `SELECT add_retention_policy('raw_readings', INTERVAL '1 day' * $1, if_not_exists => TRUE)`
+		if _, err := db.conn.Exec(query, retentionDays); err != nil {
+			return fmt.Errorf("failed to add retention policy: %w", err)
+		}
+	}
+
+	log.Println("TimescaleDB hypertables, continuous aggregates, and retention policy configured")
+	return nil
+}
+
+func (db *Database) ensureTimescaleExtension() (bool, error) {
+	if _, err := db.conn.Exec(`CREATE EXTENSION IF NOT EXISTS timescaledb`); err != nil {
+		// Most commonly the extension isn't installed on this Postgres server;
+		// treat that as "not available" rather than a fatal startup error.
+		return false, nil
+	}
+
+	var installed bool
+	err := db.conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&installed)
+	if err != nil {
+		return false, err
+	}
+	return installed, nil
+}
+
+// continuousAggregateNames maps a requested ?resolution= to the materialized
+// view that pre-computes it. Each view sums energy_wh per home_id and
+// device_category over its bucket width. The "monthly" entry names no view
+// that createContinuousAggregates creates: QueryBillingHistory serves it from
+// billing_snapshots via queryMonthlyBillingHistory, and the entry is what
+// makes billingHistoryHandler accept the resolution.
+var continuousAggregateNames = map[string]string{
+	"1min":    "raw_readings_1min",
+	"hourly":  "raw_readings_1hour",
+	"daily":   "raw_readings_1day",
+	"monthly": "billing_snapshots_1month",
+}
+
+func (db *Database) createContinuousAggregates() error {
+	aggregates := []struct {
+		view   string
+		bucket string
+		source string
+	}{
+		{"raw_readings_1min", "1 minute", "raw_readings"},
+		{"raw_readings_1hour", "1 hour", "raw_readings"},
+		{"raw_readings_1day", "1 day", "raw_readings"},
+	}
+
+	for _, agg := range aggregates {
+		createView := fmt.Sprintf(`
+			CREATE MATERIALIZED VIEW IF NOT EXISTS %s
+			WITH (timescaledb.continuous) AS
+			SELECT
+				time_bucket('%s', timestamp) AS bucket,
+				home_id,
+				device_category,
+				sum(energy_wh) AS energy_wh,
+				avg(power_w) AS avg_power_w
+			FROM %s
+			GROUP BY bucket, home_id, device_category
+			WITH NO DATA
+		`, agg.view, agg.bucket, agg.source)
+
+		if _, err := db.conn.Exec(createView); err != nil {
+			return fmt.Errorf("failed to create continuous aggregate %s: %w", agg.view, err)
+		}
+
+		policy := fmt.Sprintf(
+			`SELECT add_continuous_aggregate_policy('%s', start_offset => NULL, end_offset => INTERVAL '1 minute', schedule_interval => INTERVAL '1 minute', if_not_exists => TRUE)`,
+			agg.view,
+		)
+		if _, err := db.conn.Exec(policy); err != nil {
+			return fmt.Errorf("failed to add refresh policy for %s: %w", agg.view, err)
+		}
+	}
+
+	return nil
+}
+
+// BillingHistoryBucket is one row of a /billing/history response: energy and
+// (when available) cost aggregated over one bucket of the requested resolution.
+type BillingHistoryBucket struct {
+	Bucket    time.Time `json:"bucket"`
+	EnergyKWh float64   `json:"energy_kwh"`
+	CostTotal float64   `json:"cost_total,omitempty"`
+}
+
+// QueryBillingHistory serves paginated history from the continuous aggregate
+// matching resolution ("1min", "hourly", or "daily"), or for "monthly" from
+// billing_snapshots via queryMonthlyBillingHistory, bounded to [from, to) and
+// ordered oldest-first.
+func (db *Database) QueryBillingHistory(homeID, resolution string, from, to time.Time, limit, offset int) ([]BillingHistoryBucket, error) {
+	if resolution == "monthly" {
+		return db.queryMonthlyBillingHistory(homeID, from, to, limit, offset)
+	}
+
+	view, ok := continuousAggregateNames[resolution]
+	if !ok {
+		return nil, fmt.Errorf("unsupported resolution %q", resolution)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT bucket, sum(energy_wh) / 1000.0 AS energy_kwh
+		FROM %s
+		WHERE home_id = $1 AND bucket >= $2 AND bucket < $3
+		GROUP BY bucket
+		ORDER BY bucket ASC
+		LIMIT $4 OFFSET $5
+	`, view)
+
+	rows, err := db.conn.Query(query, homeID, from, to, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []BillingHistoryBucket
+	for rows.Next() {
+		var b BillingHistoryBucket
+		if err := rows.Scan(&b.Bucket, &b.EnergyKWh); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// queryMonthlyBillingHistory aggregates true per-interval deltas rather than
+// summing energy_today_kwh/cost_today directly: those columns are cumulative
+// since-local-midnight running totals refreshed every 5 minutes by
+// billingLoop, so summing them as-is would inflate a month's totals by
+// roughly the number of snapshot ticks in it. The deltas CTE diffs each
+// snapshot against the previous one on the same calendar day (LAG, partitioned
+// by day so the running total's own midnight reset isn't read as a negative
+// delta); normalized then applies the same rollover guard as
+// counterDeltaWh - a NULL or negative delta means either the first snapshot
+// of the day or a reset, so the running total itself is the only energy we
+// can account for.
+func (db *Database) queryMonthlyBillingHistory(homeID string, from, to time.Time, limit, offset int) ([]BillingHistoryBucket, error) {
+	query := `
+		WITH deltas AS (
+			SELECT
+				timestamp,
+				energy_today_kwh,
+				cost_today,
+				energy_today_kwh - LAG(energy_today_kwh) OVER (PARTITION BY date_trunc('day', timestamp) ORDER BY timestamp) AS energy_delta_raw,
+				cost_today - LAG(cost_today) OVER (PARTITION BY date_trunc('day', timestamp) ORDER BY timestamp) AS cost_delta_raw
+			FROM billing_snapshots
+			WHERE home_id = $1 AND timestamp >= $2 AND timestamp < $3
+		),
+		normalized AS (
+			SELECT
+				timestamp,
+				CASE WHEN energy_delta_raw IS NULL OR energy_delta_raw < 0 THEN energy_today_kwh ELSE energy_delta_raw END AS energy_delta,
+				CASE WHEN cost_delta_raw IS NULL OR cost_delta_raw < 0 THEN cost_today ELSE cost_delta_raw END AS cost_delta
+			FROM deltas
+		)
+		SELECT date_trunc('month', timestamp) AS bucket,
+		       sum(energy_delta) AS energy_kwh,
+		       sum(cost_delta) AS cost_total
+		FROM normalized
+		GROUP BY bucket
+		ORDER BY bucket ASC
+		LIMIT $4 OFFSET $5
+	`
+
+	rows, err := db.conn.Query(query, homeID, from, to, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []BillingHistoryBucket
+	for rows.Next() {
+		var b BillingHistoryBucket
+		if err := rows.Scan(&b.Bucket, &b.EnergyKWh, &b.CostTotal); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}